@@ -15,8 +15,15 @@
 package b2
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
@@ -25,24 +32,265 @@ import (
 // This file wraps the baseline interfaces with backoff and retry semantics.
 
 type beRootInterface interface {
-	backoff(error) (time.Duration, bool)
 	reauth(error) bool
 	transient(error) bool
 	authorizeAccount(context.Context, string, string) error
 	reauthorizeAccount(context.Context) error
 	createBucket(ctx context.Context, name, btype string) (beBucketInterface, error)
 	listBuckets(context.Context) ([]beBucketInterface, error)
+	createKey(ctx context.Context, name string, caps []string, valid time.Duration, bucketID, namePrefix string) (beKeyInterface, error)
+	listKeys(context.Context) ([]beKeyInterface, error)
+	capabilities() Capabilities
+	backoffPolicy() BackoffPolicy
+	accounting() Accounting
+	limitUpload(io.Reader) io.Reader
 }
 
 type beRoot struct {
 	account, key string
 	b2i          b2RootInterface
+	caps         Capabilities
+	policyOnce   sync.Once
+	policy       BackoffPolicy
+	hooks        Accounting
+	limiter      *BandwidthLimiter
+}
+
+// Accounting lets a caller observe B2 API usage as it actually happens,
+// including retried attempts, so it can be reported to Prometheus or
+// similar. B2 bills in three transaction classes: A (free writes), B (cheap
+// reads) and C (expensive listings).
+type Accounting interface {
+	BytesUploaded(bucket, name string, n int64)
+	BytesDownloaded(bucket, name string, n int64)
+	TransactionClassA(endpoint string)
+	TransactionClassB(endpoint string)
+	TransactionClassC(endpoint string)
+}
+
+// WithAccounting installs an Accounting hook on the client.
+func WithAccounting(a Accounting) ClientOption {
+	return func(r *beRoot) {
+		r.hooks = a
+	}
+}
+
+// BandwidthLimiter throttles upload throughput with a token bucket. There is
+// no download side: this package has no download path to throttle.
+type BandwidthLimiter struct {
+	up *tokenBucket
+}
+
+// NewBandwidthLimiter builds a BandwidthLimiter with the given per-second
+// byte rate and burst size. A zero rate leaves uploads unlimited.
+func NewBandwidthLimiter(bytesPerSec, burst int64) *BandwidthLimiter {
+	return &BandwidthLimiter{
+		up: newTokenBucket(bytesPerSec, burst),
+	}
+}
+
+// WithBandwidthLimiter installs a BandwidthLimiter that throttles every
+// upload made through the client.
+func WithBandwidthLimiter(bl *BandwidthLimiter) ClientOption {
+	return func(r *beRoot) {
+		r.limiter = bl
+	}
+}
+
+type tokenBucket struct {
+	rate, burst int64
+
+	mu     sync.Mutex
+	tokens int64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+func (b *tokenBucket) wait(n int64) {
+	if b == nil {
+		return
+	}
+	for n > b.burst {
+		b.wait(b.burst)
+		n -= b.burst
+	}
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		if !b.last.IsZero() {
+			b.tokens += int64(now.Sub(b.last).Seconds() * float64(b.rate))
+			if b.tokens > b.burst {
+				b.tokens = b.burst
+			}
+		}
+		b.last = now
+		if b.tokens >= n {
+			b.tokens -= n
+			b.mu.Unlock()
+			return
+		}
+		wait := time.Duration(float64(n-b.tokens) / float64(b.rate) * float64(time.Second))
+		b.mu.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// limitedReader throttles reads against a tokenBucket, used for uploads.
+type limitedReader struct {
+	r io.Reader
+	b *tokenBucket
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if n > 0 {
+		l.b.wait(int64(n))
+	}
+	return n, err
+}
+
+// ClientOption configures optional behavior of a beRoot, mirroring the
+// option pattern used by the public client.
+type ClientOption func(*beRoot)
+
+// WithBackoffPolicy overrides the default decorrelated-jitter backoff policy
+// used between retried requests.
+func WithBackoffPolicy(bp BackoffPolicy) ClientOption {
+	return func(r *beRoot) {
+		r.policy = bp
+	}
+}
+
+// BackoffPolicy decides how long to wait between retried requests. A
+// BackoffPolicy is installed once per beRoot, but a single beRoot can back
+// many concurrent in-flight requests (e.g. parallel large-file part
+// uploads), so NewChain is called once per logical retry loop (withBackoff,
+// uploadPart's re-send loop) to get state scoped to just that loop —
+// concurrent callers of NewChain must never share or perturb each other's
+// retry state.
+type BackoffPolicy interface {
+	// NewChain returns a BackoffPolicy scoped to a single logical retry
+	// chain, used only by the one goroutine driving that chain.
+	// Implementations that keep no cross-attempt state (beyond static
+	// configuration) may return themselves.
+	NewChain() BackoffPolicy
+	// Next returns how long to sleep before retrying the given attempt
+	// (1-indexed), and whether a retry should be attempted at all. It is
+	// consulted on every retry, even when the backend supplies its own
+	// explicit delay, so it remains the single place attempt-count caps
+	// are enforced.
+	Next(attempt int, lastErr error) (time.Duration, bool)
+}
+
+// decorrelatedJitterBackoff is the default BackoffPolicy. It honors a
+// server-supplied Retry-After when one is present on the error, and
+// otherwise backs off using AWS-style decorrelated jitter. A chain returned
+// by NewChain is only ever driven by one goroutine, so prev needs no
+// synchronization.
+type decorrelatedJitterBackoff struct {
+	base, cap   time.Duration
+	maxAttempts int
+
+	prev time.Duration
+}
+
+func newDecorrelatedJitterBackoff() *decorrelatedJitterBackoff {
+	return &decorrelatedJitterBackoff{
+		base:        500 * time.Millisecond,
+		cap:         60 * time.Second,
+		maxAttempts: 10,
+	}
+}
+
+func (p *decorrelatedJitterBackoff) NewChain() BackoffPolicy {
+	return &decorrelatedJitterBackoff{
+		base:        p.base,
+		cap:         p.cap,
+		maxAttempts: p.maxAttempts,
+	}
+}
+
+func (p *decorrelatedJitterBackoff) Next(attempt int, lastErr error) (time.Duration, bool) {
+	if p.maxAttempts > 0 && attempt > p.maxAttempts {
+		return 0, false
+	}
+	if d, ok := retryAfter(lastErr); ok {
+		p.prev = d
+		return d, true
+	}
+	prev := p.prev
+	if prev < p.base {
+		prev = p.base
+	}
+	hi := prev * 3
+	d := p.base + time.Duration(rand.Int63n(int64(hi-p.base+1)))
+	if d > p.cap {
+		d = p.cap
+	}
+	p.prev = d
+	return d, true
+}
+
+// RetryAfterError is implemented by errors that carry a raw HTTP
+// Retry-After header value, in either delta-seconds or HTTP-date form, so
+// that a BackoffPolicy can honor it directly instead of it being silently
+// forced on the policy by backend-specific code. The method is exported
+// because the concrete errors that implement it (e.g. those returned by a
+// B2-compatible backend) generally live outside this package.
+type RetryAfterError interface {
+	HTTPRetryAfter() (string, bool)
+}
+
+func retryAfter(err error) (time.Duration, bool) {
+	rae, ok := err.(RetryAfterError)
+	if !ok {
+		return 0, false
+	}
+	v, ok := rae.HTTPRetryAfter()
+	if !ok {
+		return 0, false
+	}
+	return parseRetryAfter(v)
+}
+
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// Capabilities describes what an authorized account or application key is
+// allowed to do, as returned by b2_authorize_account.
+type Capabilities struct {
+	Capabilities []string
+	Bucket       string
+	NamePrefix   string
 }
 
 type beBucketInterface interface {
 	name() string
 	deleteBucket(context.Context) error
 	getUploadURL(context.Context) (beURLInterface, error)
+	startLargeFile(ctx context.Context, name, ct string, info map[string]string, sse *EncryptionSettings) (beLargeFileInterface, error)
+	listUnfinishedLargeFiles(context.Context) ([]beLargeFileInterface, error)
+	setDefaultEncryption(context.Context, *EncryptionSettings) error
+	defaultEncryption(context.Context) (*EncryptionSettings, error)
 }
 
 type beBucket struct {
@@ -51,16 +299,67 @@ type beBucket struct {
 }
 
 type beURLInterface interface {
-	uploadFile(context.Context, io.Reader, int, string, string, string, map[string]string) (beFileInterface, error)
+	uploadFile(context.Context, io.Reader, int, string, string, string, map[string]string, *EncryptionSettings) (beFileInterface, error)
+}
+
+// EncryptionMode selects between Backblaze-managed (SSE-B2) and
+// customer-managed (SSE-C) server-side encryption.
+type EncryptionMode string
+
+const (
+	SSEB2 EncryptionMode = "SSE-B2"
+	SSEC  EncryptionMode = "SSE-C"
+)
+
+// EncryptionSettings carries the server-side encryption parameters passed
+// with uploadFile and startLargeFile (B2's b2_upload_file and
+// b2_start_large_file, which take them as X-Bz-Server-Side-Encryption*
+// headers) and returned on file-info structs. This package has no download
+// path, so they are not sent on downloads.
+// For SSEC, CustomerKey and CustomerKeyMD5 must never be logged.
+type EncryptionSettings struct {
+	Mode           EncryptionMode
+	Algorithm      string
+	CustomerKey    []byte
+	CustomerKeyMD5 string
+}
+
+// sseCustomerKeyHeaderPrefix is the header prefix carrying SSE-C key
+// material. Anything logging request or response headers must redact
+// values under this prefix instead of writing them out.
+const sseCustomerKeyHeaderPrefix = "X-Bz-Server-Side-Encryption-Customer-Key"
+
+// redactHeader returns "<redacted>" for any header under the SSE-C
+// customer-key prefix and the value unchanged otherwise. String below uses
+// it so that printed EncryptionSettings never leak customer encryption keys.
+func redactHeader(name, value string) string {
+	if strings.HasPrefix(name, sseCustomerKeyHeaderPrefix) {
+		return "<redacted>"
+	}
+	return value
+}
+
+// String implements fmt.Stringer so that an EncryptionSettings printed with
+// %v or %s, including through error wrapping, never leaks the SSE-C
+// customer key.
+func (e *EncryptionSettings) String() string {
+	if e == nil {
+		return "<nil>"
+	}
+	key := redactHeader(sseCustomerKeyHeaderPrefix, string(e.CustomerKey))
+	keyMD5 := redactHeader(sseCustomerKeyHeaderPrefix+"-Md5", e.CustomerKeyMD5)
+	return fmt.Sprintf("EncryptionSettings{Mode: %s, Algorithm: %s, CustomerKey: %s, CustomerKeyMD5: %s}", e.Mode, e.Algorithm, key, keyMD5)
 }
 
 type beURL struct {
-	b2url b2URLInterface
-	ri    beRootInterface
+	b2url  b2URLInterface
+	ri     beRootInterface
+	bucket string
 }
 
 type beFileInterface interface {
 	deleteFileVersion(context.Context) error
+	info() FileInfo
 }
 
 type beFile struct {
@@ -69,9 +368,75 @@ type beFile struct {
 	ri     beRootInterface
 }
 
-func (r *beRoot) backoff(err error) (time.Duration, bool) { return r.b2i.backoff(err) }
-func (r *beRoot) reauth(err error) bool                   { return r.b2i.reauth(err) }
-func (r *beRoot) transient(err error) bool                { return r.b2i.transient(err) }
+// FileInfo reports the server-side encryption that actually ended up on an
+// uploaded file, whether it came from an explicit per-upload setting or the
+// bucket's default, as returned on file-info structs by b2_upload_file,
+// b2_finish_large_file and friends.
+type FileInfo struct {
+	Encryption *EncryptionSettings
+}
+
+type beKeyInterface interface {
+	deleteKey(context.Context) error
+	info() KeyInfo
+}
+
+type beKey struct {
+	b2key b2KeyInterface
+	ri    beRootInterface
+}
+
+// KeyInfo describes an application key: the ID, name, capabilities and
+// bucket/name-prefix restriction returned by both b2_create_key and
+// b2_list_keys, plus the ApplicationKey secret needed to actually
+// authenticate with it. Real B2 only returns the secret from
+// b2_create_key, never from b2_list_keys; callers that need to use a key
+// again later must save it at creation time.
+type KeyInfo struct {
+	ID             string
+	Name           string
+	Capabilities   []string
+	BucketID       string
+	NamePrefix     string
+	ApplicationKey string
+}
+
+type beLargeFileInterface interface {
+	fileID() string
+	getUploadPartURL(context.Context) (beFilePartInterface, error)
+	finishLargeFile(context.Context, []string) (beFileInterface, error)
+	cancelLargeFile(context.Context) error
+	listParts(context.Context) ([]*FilePartInfo, error)
+}
+
+type beLargeFile struct {
+	b2largeFile  b2LargeFileInterface
+	ri           beRootInterface
+	bucket, name string
+}
+
+// FilePartInfo describes a single part of an in-progress large file upload,
+// as returned by b2_list_parts. It is used to resume an interrupted upload
+// by skipping parts whose SHA1 already matches.
+type FilePartInfo struct {
+	Number int
+	SHA1   string
+	Size   int
+}
+
+type beFilePartInterface interface {
+	uploadPart(ctx context.Context, r io.Reader, sha1 string, size, index int) (int, error)
+}
+
+type beFilePart struct {
+	b2filePart   b2FilePartInterface
+	ri           beRootInterface
+	lf           beLargeFileInterface
+	bucket, name string
+}
+
+func (r *beRoot) reauth(err error) bool    { return r.b2i.reauth(err) }
+func (r *beRoot) transient(err error) bool { return r.b2i.transient(err) }
 
 func (r *beRoot) authorizeAccount(ctx context.Context, account, key string) error {
 	f := func() (bool, error) {
@@ -80,6 +445,7 @@ func (r *beRoot) authorizeAccount(ctx context.Context, account, key string) erro
 		}
 		r.account = account
 		r.key = key
+		r.caps = r.b2i.capabilities()
 		return true, nil
 	}
 	return withBackoff(ctx, r, f)
@@ -89,6 +455,32 @@ func (r *beRoot) reauthorizeAccount(ctx context.Context) error {
 	return r.authorizeAccount(ctx, r.account, r.key)
 }
 
+func (r *beRoot) capabilities() Capabilities { return r.caps }
+
+// Capabilities returns the capabilities, and any bucket or name-prefix
+// restriction, attached to the current auth token. This snapshot has no
+// separate public Client type, so this is the exported accessor a Client
+// would otherwise forward to.
+func (r *beRoot) Capabilities() Capabilities { return r.caps }
+
+func (r *beRoot) backoffPolicy() BackoffPolicy {
+	r.policyOnce.Do(func() {
+		if r.policy == nil {
+			r.policy = newDecorrelatedJitterBackoff()
+		}
+	})
+	return r.policy
+}
+
+func (r *beRoot) accounting() Accounting { return r.hooks }
+
+func (r *beRoot) limitUpload(rdr io.Reader) io.Reader {
+	if r.limiter == nil || r.limiter.up == nil {
+		return rdr
+	}
+	return &limitedReader{r: rdr, b: r.limiter.up}
+}
+
 func (r *beRoot) createBucket(ctx context.Context, name, btype string) (beBucketInterface, error) {
 	var bi beBucketInterface
 	f := func() (bool, error) {
@@ -118,6 +510,9 @@ func (r *beRoot) listBuckets(ctx context.Context) ([]beBucketInterface, error) {
 	var buckets []beBucketInterface
 	f := func() (bool, error) {
 		g := func() error {
+			if r.hooks != nil {
+				r.hooks.TransactionClassC("b2_list_buckets")
+			}
 			bs, err := r.b2i.listBuckets(ctx)
 			if err != nil {
 				return err
@@ -141,6 +536,58 @@ func (r *beRoot) listBuckets(ctx context.Context) ([]beBucketInterface, error) {
 	return buckets, nil
 }
 
+func (r *beRoot) createKey(ctx context.Context, name string, caps []string, valid time.Duration, bucketID, namePrefix string) (beKeyInterface, error) {
+	var key beKeyInterface
+	f := func() (bool, error) {
+		g := func() error {
+			k, err := r.b2i.createKey(ctx, name, caps, valid, bucketID, namePrefix)
+			if err != nil {
+				return err
+			}
+			key = &beKey{
+				b2key: k,
+				ri:    r,
+			}
+			return nil
+		}
+		if err := withReauth(ctx, r, g); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if err := withBackoff(ctx, r, f); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (r *beRoot) listKeys(ctx context.Context) ([]beKeyInterface, error) {
+	var keys []beKeyInterface
+	f := func() (bool, error) {
+		g := func() error {
+			ks, err := r.b2i.listKeys(ctx)
+			if err != nil {
+				return err
+			}
+			for _, k := range ks {
+				keys = append(keys, &beKey{
+					b2key: k,
+					ri:    r,
+				})
+			}
+			return nil
+		}
+		if err := withReauth(ctx, r, g); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if err := withBackoff(ctx, r, f); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
 func (b *beBucket) name() string {
 	return b.b2bucket.name()
 }
@@ -158,6 +605,41 @@ func (b *beBucket) deleteBucket(ctx context.Context) error {
 	return withBackoff(ctx, b.ri, f)
 }
 
+func (b *beBucket) setDefaultEncryption(ctx context.Context, sse *EncryptionSettings) error {
+	f := func() (bool, error) {
+		g := func() error {
+			return b.b2bucket.setDefaultEncryption(ctx, sse)
+		}
+		if err := withReauth(ctx, b.ri, g); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return withBackoff(ctx, b.ri, f)
+}
+
+func (b *beBucket) defaultEncryption(ctx context.Context) (*EncryptionSettings, error) {
+	var sse *EncryptionSettings
+	f := func() (bool, error) {
+		g := func() error {
+			s, err := b.b2bucket.defaultEncryption(ctx)
+			if err != nil {
+				return err
+			}
+			sse = s
+			return nil
+		}
+		if err := withReauth(ctx, b.ri, g); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if err := withBackoff(ctx, b.ri, f); err != nil {
+		return nil, err
+	}
+	return sse, nil
+}
+
 func (b *beBucket) getUploadURL(ctx context.Context) (beURLInterface, error) {
 	var url beURLInterface
 	f := func() (bool, error) {
@@ -167,8 +649,9 @@ func (b *beBucket) getUploadURL(ctx context.Context) (beURLInterface, error) {
 				return err
 			}
 			url = &beURL{
-				b2url: u,
-				ri:    b.ri,
+				b2url:  u,
+				ri:     b.ri,
+				bucket: b.name(),
 			}
 			return nil
 		}
@@ -183,14 +666,75 @@ func (b *beBucket) getUploadURL(ctx context.Context) (beURLInterface, error) {
 	return url, nil
 }
 
-func (b *beURL) uploadFile(ctx context.Context, r io.Reader, size int, name, ct, sha1 string, info map[string]string) (beFileInterface, error) {
+func (b *beBucket) startLargeFile(ctx context.Context, name, ct string, info map[string]string, sse *EncryptionSettings) (beLargeFileInterface, error) {
+	var lf beLargeFileInterface
+	f := func() (bool, error) {
+		g := func() error {
+			l, err := b.b2bucket.startLargeFile(ctx, name, ct, info, sse)
+			if err != nil {
+				return err
+			}
+			lf = &beLargeFile{
+				b2largeFile: l,
+				ri:          b.ri,
+				bucket:      b.name(),
+				name:        name,
+			}
+			return nil
+		}
+		if err := withReauth(ctx, b.ri, g); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if err := withBackoff(ctx, b.ri, f); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+func (b *beBucket) listUnfinishedLargeFiles(ctx context.Context) ([]beLargeFileInterface, error) {
+	var lfs []beLargeFileInterface
+	f := func() (bool, error) {
+		g := func() error {
+			ls, err := b.b2bucket.listUnfinishedLargeFiles(ctx)
+			if err != nil {
+				return err
+			}
+			for _, l := range ls {
+				lfs = append(lfs, &beLargeFile{
+					b2largeFile: l,
+					ri:          b.ri,
+				})
+			}
+			return nil
+		}
+		if err := withReauth(ctx, b.ri, g); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if err := withBackoff(ctx, b.ri, f); err != nil {
+		return nil, err
+	}
+	return lfs, nil
+}
+
+func (b *beURL) uploadFile(ctx context.Context, r io.Reader, size int, name, ct, sha1 string, info map[string]string, sse *EncryptionSettings) (beFileInterface, error) {
+	lr := b.ri.limitUpload(r)
 	var file beFileInterface
 	f := func() (bool, error) {
 		g := func() error {
-			f, err := b.b2url.uploadFile(ctx, r, size, name, ct, sha1, info)
+			if a := b.ri.accounting(); a != nil {
+				a.TransactionClassA("b2_upload_file")
+			}
+			f, err := b.b2url.uploadFile(ctx, lr, size, name, ct, sha1, info, sse)
 			if err != nil {
 				return err
 			}
+			if a := b.ri.accounting(); a != nil {
+				a.BytesUploaded(b.bucket, name, int64(size))
+			}
 			file = &beFile{
 				b2file: f,
 				url:    b,
@@ -212,6 +756,9 @@ func (b *beURL) uploadFile(ctx context.Context, r io.Reader, size int, name, ct,
 func (b *beFile) deleteFileVersion(ctx context.Context) error {
 	f := func() (bool, error) {
 		g := func() error {
+			if a := b.ri.accounting(); a != nil {
+				a.TransactionClassA("b2_delete_file_version")
+			}
 			return b.b2file.deleteFileVersion(ctx)
 		}
 		if err := withReauth(ctx, b.ri, g); err != nil {
@@ -222,22 +769,332 @@ func (b *beFile) deleteFileVersion(ctx context.Context) error {
 	return withBackoff(ctx, b.ri, f)
 }
 
-func jitter(d time.Duration) time.Duration {
-	f := float64(d)
-	f /= 50
-	f += f * (rand.Float64() - 0.5)
-	return time.Duration(f)
+func (b *beFile) info() FileInfo { return b.b2file.info() }
+
+// Info returns the server-side encryption actually applied to this file.
+func (b *beFile) Info() FileInfo { return b.info() }
+
+func (l *beLargeFile) fileID() string { return l.b2largeFile.fileID() }
+
+func (l *beLargeFile) getUploadPartURL(ctx context.Context) (beFilePartInterface, error) {
+	var part beFilePartInterface
+	f := func() (bool, error) {
+		g := func() error {
+			p, err := l.b2largeFile.getUploadPartURL(ctx)
+			if err != nil {
+				return err
+			}
+			part = &beFilePart{
+				b2filePart: p,
+				ri:         l.ri,
+				lf:         l,
+				bucket:     l.bucket,
+				name:       l.name,
+			}
+			return nil
+		}
+		if err := withReauth(ctx, l.ri, g); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if err := withBackoff(ctx, l.ri, f); err != nil {
+		return nil, err
+	}
+	return part, nil
+}
+
+func (l *beLargeFile) finishLargeFile(ctx context.Context, hashes []string) (beFileInterface, error) {
+	var file beFileInterface
+	f := func() (bool, error) {
+		g := func() error {
+			fl, err := l.b2largeFile.finishLargeFile(ctx, hashes)
+			if err != nil {
+				return err
+			}
+			file = &beFile{
+				b2file: fl,
+				ri:     l.ri,
+			}
+			return nil
+		}
+		if err := withReauth(ctx, l.ri, g); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if err := withBackoff(ctx, l.ri, f); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (l *beLargeFile) cancelLargeFile(ctx context.Context) error {
+	f := func() (bool, error) {
+		g := func() error {
+			return l.b2largeFile.cancelLargeFile(ctx)
+		}
+		if err := withReauth(ctx, l.ri, g); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return withBackoff(ctx, l.ri, f)
+}
+
+func (l *beLargeFile) listParts(ctx context.Context) ([]*FilePartInfo, error) {
+	var parts []*FilePartInfo
+	f := func() (bool, error) {
+		g := func() error {
+			p, err := l.b2largeFile.listParts(ctx)
+			if err != nil {
+				return err
+			}
+			parts = p
+			return nil
+		}
+		if err := withReauth(ctx, l.ri, g); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if err := withBackoff(ctx, l.ri, f); err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+// uploadPart does not go through the generic withBackoff/withReauth
+// wrappers: a part-upload URL is single-use and single-threaded per B2's
+// docs, so on a transient failure it must be discarded and a fresh one
+// obtained from the owning large file rather than retried. That requires a
+// re-readable r; callers whose reader isn't an io.Seeker get zero retries
+// on transient failure, since the part can't be safely re-sent.
+func (p *beFilePart) uploadPart(ctx context.Context, r io.Reader, sha1 string, size, index int) (int, error) {
+	policy := p.ri.backoffPolicy().NewChain()
+	seeker, resettable := r.(io.Seeker)
+	lr := p.ri.limitUpload(r)
+	cur := p.b2filePart
+	attempt := 0
+	for {
+		if a := p.ri.accounting(); a != nil {
+			a.TransactionClassA("b2_upload_part")
+		}
+		n, err := cur.uploadPart(ctx, lr, sha1, size, index)
+		if err == nil {
+			if a := p.ri.accounting(); a != nil {
+				a.BytesUploaded(p.bucket, p.name, int64(n))
+			}
+			return n, nil
+		}
+		if p.ri.reauth(err) {
+			if rerr := p.ri.reauthorizeAccount(ctx); rerr != nil {
+				return 0, rerr
+			}
+		}
+		if !p.ri.transient(err) || !resettable {
+			return 0, err
+		}
+		attempt++
+		backoff, ok := policy.Next(attempt, err)
+		if !ok {
+			return 0, err
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(backoff):
+		}
+		fresh, ferr := p.lf.getUploadPartURL(ctx)
+		if ferr != nil {
+			return 0, ferr
+		}
+		fp, ok := fresh.(*beFilePart)
+		if !ok {
+			return 0, err
+		}
+		cur = fp.b2filePart
+		p.b2filePart = fp.b2filePart
+		if _, serr := seeker.Seek(0, io.SeekStart); serr != nil {
+			return 0, serr
+		}
+	}
 }
 
-func getBackoff(d time.Duration) time.Duration {
-	if d > 15*time.Second {
-		return d + jitter(d)
+// DefaultLargeFileThreshold is the buffered upload size at which a Writer
+// should switch from a single b2_upload_file call to the large-file
+// pipeline below.
+const DefaultLargeFileThreshold = 100 * 1 << 20 // 100 MiB
+
+// MinLargeFilePartSize is the minimum part size B2 accepts for a large
+// file; callers must not configure anything smaller.
+const MinLargeFilePartSize = 5 * 1 << 20 // 5 MiB
+
+func sha1OfSection(r io.ReaderAt, off, n int64) (string, error) {
+	h := sha1.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, off, n)); err != nil {
+		return "", err
 	}
-	return d*2 + jitter(d*2)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// uploadLargeFileParts uploads the 1-indexed parts of an in-progress large
+// file from r using a pool of concurrency part-upload URLs, one per
+// concurrent uploader since each URL is single-threaded per B2's docs. A
+// part already present in existingParts with a matching SHA1 is skipped,
+// which is the resume path: the caller re-derives existingParts from
+// b2_list_parts. It returns the finished part hashes in order, ready for
+// beLargeFileInterface.finishLargeFile.
+func uploadLargeFileParts(ctx context.Context, lf beLargeFileInterface, r io.ReaderAt, size, partSize int64, concurrency int, existingParts map[int]string) ([]string, error) {
+	numParts := int((size + partSize - 1) / partSize)
+	if numParts == 0 {
+		numParts = 1
+	}
+	hashes := make([]string, numParts+1) // 1-indexed; hashes[0] unused
+
+	// jobs is buffered to hold every part index up front, so the producer
+	// below can never block on a send: if a worker exits early (a failed
+	// getUploadPartURL, a cancelled ctx tripping every in-flight uploadPart
+	// at once), the producer still finishes and the goroutine doesn't leak.
+	jobs := make(chan int, numParts)
+	errs := make(chan error, concurrency)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	worker := func() {
+		defer wg.Done()
+		part, err := lf.getUploadPartURL(ctx)
+		if err != nil {
+			errs <- err
+			return
+		}
+		for index := range jobs {
+			off := int64(index-1) * partSize
+			n := partSize
+			if off+n > size {
+				n = size - off
+			}
+			sum, err := sha1OfSection(r, off, n)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if existing, ok := existingParts[index]; ok && existing == sum {
+				mu.Lock()
+				hashes[index] = sum
+				mu.Unlock()
+				continue
+			}
+			if _, err := part.uploadPart(ctx, io.NewSectionReader(r, off, n), sum, int(n), index); err != nil {
+				errs <- err
+				return
+			}
+			mu.Lock()
+			hashes[index] = sum
+			mu.Unlock()
+		}
+	}
+
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go worker()
+	}
+	go func() {
+		for index := 1; index <= numParts; index++ {
+			jobs <- index
+		}
+		close(jobs)
+	}()
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return hashes[1:], nil
+}
+
+// uploadLargeFile uploads r (size bytes) as a new B2 large file, fanning
+// part uploads out across concurrency part-upload URLs.
+func uploadLargeFile(ctx context.Context, bucket beBucketInterface, name, ct string, info map[string]string, sse *EncryptionSettings, r io.ReaderAt, size, partSize int64, concurrency int) (beFileInterface, error) {
+	if partSize < MinLargeFilePartSize {
+		partSize = MinLargeFilePartSize
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	lf, err := bucket.startLargeFile(ctx, name, ct, info, sse)
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := uploadLargeFileParts(ctx, lf, r, size, partSize, concurrency, nil)
+	if err != nil {
+		return nil, err
+	}
+	return lf.finishLargeFile(ctx, hashes)
+}
+
+// resumeLargeFile reattaches to the unfinished large file fileID (as
+// returned by b2_start_large_file) and finishes uploading it, skipping any
+// part b2_list_parts reports whose SHA1 already matches.
+func resumeLargeFile(ctx context.Context, bucket beBucketInterface, fileID string, r io.ReaderAt, size, partSize int64, concurrency int) (beFileInterface, error) {
+	lfs, err := bucket.listUnfinishedLargeFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var lf beLargeFileInterface
+	for _, cand := range lfs {
+		if cand.fileID() == fileID {
+			lf = cand
+			break
+		}
+	}
+	if lf == nil {
+		return nil, fmt.Errorf("b2: no unfinished large file with ID %q", fileID)
+	}
+	parts, err := lf.listParts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[int]string, len(parts))
+	for _, p := range parts {
+		existing[p.Number] = p.SHA1
+	}
+	if partSize < MinLargeFilePartSize {
+		partSize = MinLargeFilePartSize
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	hashes, err := uploadLargeFileParts(ctx, lf, r, size, partSize, concurrency, existing)
+	if err != nil {
+		return nil, err
+	}
+	return lf.finishLargeFile(ctx, hashes)
+}
+
+func (k *beKey) info() KeyInfo { return k.b2key.info() }
+
+// Info returns the key's ID, name, capabilities, bucket/name-prefix
+// restriction and (for a freshly created key) the ApplicationKey secret
+// needed to authenticate with it.
+func (k *beKey) Info() KeyInfo { return k.info() }
+
+func (k *beKey) deleteKey(ctx context.Context) error {
+	f := func() (bool, error) {
+		g := func() error {
+			return k.b2key.deleteKey(ctx)
+		}
+		if err := withReauth(ctx, k.ri, g); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return withBackoff(ctx, k.ri, f)
 }
 
 func withBackoff(ctx context.Context, ri beRootInterface, f func() (bool, error)) error {
-	backoff := 500 * time.Millisecond
+	policy := ri.backoffPolicy().NewChain()
+	attempt := 0
 	for {
 		final, err := f()
 		if final {
@@ -246,11 +1103,10 @@ func withBackoff(ctx context.Context, ri beRootInterface, f func() (bool, error)
 		if !ri.transient(err) {
 			return err
 		}
-		bo, ok := ri.backoff(err)
-		if ok {
-			backoff = bo
-		} else {
-			backoff = getBackoff(backoff)
+		attempt++
+		backoff, ok := policy.Next(attempt, err)
+		if !ok {
+			return err
 		}
 		select {
 		case <-ctx.Done():
@@ -0,0 +1,261 @@
+// Copyright 2016, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"io"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/quad/blazer/b2fake"
+)
+
+// This file adapts the in-memory b2fake package onto the b2RootInterface
+// family so that beRoot (and everything built on top of it) can run against
+// a hermetic fake instead of the real B2 service.
+
+// NewFakeClient builds a hermetic, in-memory B2 backend and returns it
+// already authorized, along with the underlying b2fake.Root so tests can
+// toggle its fault-injection knobs (FailSomeUploads, ExpireSomeAuthTokens,
+// ForceCapExceeded, Latency, RetryAfter).
+func NewFakeClient(ctx context.Context, opts ...ClientOption) (beRootInterface, *b2fake.Root, error) {
+	fr := b2fake.New()
+	r := &beRoot{b2i: &fakeRoot{fr}}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if err := r.authorizeAccount(ctx, "fake", "fake"); err != nil {
+		return nil, nil, err
+	}
+	return r, fr, nil
+}
+
+func fakeErr(err error) (*b2fake.Error, bool) {
+	fe, ok := err.(*b2fake.Error)
+	return fe, ok
+}
+
+type fakeRoot struct{ r *b2fake.Root }
+
+func (f *fakeRoot) reauth(err error) bool {
+	fe, ok := fakeErr(err)
+	return ok && fe.Status == 401 && fe.Code == "expired_auth_token"
+}
+
+func (f *fakeRoot) transient(err error) bool {
+	fe, ok := fakeErr(err)
+	if !ok {
+		return false
+	}
+	if fe.Status == 401 && fe.Code == "unauthorized" {
+		return false // capability-denied, not transient
+	}
+	return fe.Status == 503 || fe.Status == 429 || (fe.Status == 401 && fe.Code == "expired_auth_token")
+}
+
+func (f *fakeRoot) authorizeAccount(ctx context.Context, account, key string) error {
+	return f.r.AuthorizeAccount(ctx, account, key)
+}
+
+func (f *fakeRoot) capabilities() Capabilities {
+	caps, bucket, prefix := f.r.Capabilities()
+	return Capabilities{Capabilities: caps, Bucket: bucket, NamePrefix: prefix}
+}
+
+func (f *fakeRoot) createBucket(ctx context.Context, name, btype string) (b2BucketInterface, error) {
+	b, err := f.r.CreateBucket(ctx, name, btype)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeBucket{b}, nil
+}
+
+func (f *fakeRoot) listBuckets(ctx context.Context) ([]b2BucketInterface, error) {
+	bs, err := f.r.ListBuckets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]b2BucketInterface, len(bs))
+	for i, b := range bs {
+		out[i] = &fakeBucket{b}
+	}
+	return out, nil
+}
+
+func (f *fakeRoot) createKey(ctx context.Context, name string, caps []string, valid time.Duration, bucketID, namePrefix string) (b2KeyInterface, error) {
+	k, err := f.r.CreateKey(ctx, name, caps, valid, bucketID, namePrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeKey{k}, nil
+}
+
+func (f *fakeRoot) listKeys(ctx context.Context) ([]b2KeyInterface, error) {
+	ks, err := f.r.ListKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]b2KeyInterface, len(ks))
+	for i, k := range ks {
+		out[i] = &fakeKey{k}
+	}
+	return out, nil
+}
+
+type fakeKey struct{ k *b2fake.Key }
+
+func (f *fakeKey) deleteKey(ctx context.Context) error { return f.k.DeleteKey(ctx) }
+
+func (f *fakeKey) info() KeyInfo {
+	return KeyInfo{
+		ID:             f.k.ID,
+		Name:           f.k.Name,
+		Capabilities:   f.k.Capabilities,
+		BucketID:       f.k.BucketID,
+		NamePrefix:     f.k.NamePrefix,
+		ApplicationKey: f.k.ApplicationKey,
+	}
+}
+
+type fakeBucket struct{ b *b2fake.Bucket }
+
+func (f *fakeBucket) name() string { return f.b.Name() }
+
+func (f *fakeBucket) deleteBucket(ctx context.Context) error { return f.b.Delete(ctx) }
+
+func (f *fakeBucket) getUploadURL(ctx context.Context) (b2URLInterface, error) {
+	u, err := f.b.GetUploadURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeURL{u}, nil
+}
+
+func (f *fakeBucket) startLargeFile(ctx context.Context, name, ct string, info map[string]string, sse *EncryptionSettings) (b2LargeFileInterface, error) {
+	lf, err := f.b.StartLargeFile(ctx, name, ct, info, toFakeEncryption(sse))
+	if err != nil {
+		return nil, err
+	}
+	return &fakeLargeFile{lf}, nil
+}
+
+func (f *fakeBucket) listUnfinishedLargeFiles(ctx context.Context) ([]b2LargeFileInterface, error) {
+	lfs, err := f.b.ListUnfinishedLargeFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]b2LargeFileInterface, len(lfs))
+	for i, lf := range lfs {
+		out[i] = &fakeLargeFile{lf}
+	}
+	return out, nil
+}
+
+func (f *fakeBucket) setDefaultEncryption(ctx context.Context, sse *EncryptionSettings) error {
+	return f.b.SetDefaultEncryption(ctx, toFakeEncryption(sse))
+}
+
+func (f *fakeBucket) defaultEncryption(ctx context.Context) (*EncryptionSettings, error) {
+	sse, err := f.b.DefaultEncryption(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return fromFakeEncryption(sse), nil
+}
+
+type fakeURL struct{ u *b2fake.URL }
+
+func (f *fakeURL) uploadFile(ctx context.Context, r io.Reader, size int, name, ct, sha1 string, info map[string]string, sse *EncryptionSettings) (b2FileInterface, error) {
+	fv, err := f.u.UploadFile(ctx, r, size, name, ct, sha1, info, toFakeEncryption(sse))
+	if err != nil {
+		return nil, err
+	}
+	return &fakeFile{fv}, nil
+}
+
+type fakeFile struct{ fv *b2fake.FileVersion }
+
+func (f *fakeFile) deleteFileVersion(ctx context.Context) error { return f.fv.DeleteFileVersion(ctx) }
+
+func (f *fakeFile) info() FileInfo {
+	return FileInfo{Encryption: fromFakeEncryption(f.fv.Encryption())}
+}
+
+type fakeLargeFile struct{ lf *b2fake.LargeFile }
+
+func (f *fakeLargeFile) fileID() string { return f.lf.ID() }
+
+func (f *fakeLargeFile) getUploadPartURL(ctx context.Context) (b2FilePartInterface, error) {
+	p, err := f.lf.GetUploadPartURL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeFilePart{p}, nil
+}
+
+func (f *fakeLargeFile) finishLargeFile(ctx context.Context, hashes []string) (b2FileInterface, error) {
+	fv, err := f.lf.FinishLargeFile(ctx, hashes)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeFile{fv}, nil
+}
+
+func (f *fakeLargeFile) cancelLargeFile(ctx context.Context) error {
+	return f.lf.CancelLargeFile(ctx)
+}
+
+func (f *fakeLargeFile) listParts(ctx context.Context) ([]*FilePartInfo, error) {
+	ps, err := f.lf.ListParts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*FilePartInfo, len(ps))
+	for i, p := range ps {
+		out[i] = &FilePartInfo{Number: p.Number, SHA1: p.SHA1, Size: p.Size}
+	}
+	return out, nil
+}
+
+type fakeFilePart struct{ p *b2fake.FilePart }
+
+func (f *fakeFilePart) uploadPart(ctx context.Context, r io.Reader, sha1 string, size, index int) (int, error) {
+	return f.p.UploadPart(ctx, r, sha1, size, index)
+}
+
+func toFakeEncryption(sse *EncryptionSettings) *b2fake.EncryptionInfo {
+	if sse == nil {
+		return nil
+	}
+	return &b2fake.EncryptionInfo{
+		Mode:           string(sse.Mode),
+		Algorithm:      sse.Algorithm,
+		CustomerKey:    sse.CustomerKey,
+		CustomerKeyMD5: sse.CustomerKeyMD5,
+	}
+}
+
+func fromFakeEncryption(sse *b2fake.EncryptionInfo) *EncryptionSettings {
+	if sse == nil {
+		return nil
+	}
+	return &EncryptionSettings{
+		Mode:           EncryptionMode(sse.Mode),
+		Algorithm:      sse.Algorithm,
+		CustomerKey:    sse.CustomerKey,
+		CustomerKeyMD5: sse.CustomerKeyMD5,
+	}
+}
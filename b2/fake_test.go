@@ -0,0 +1,196 @@
+// Copyright 2016, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func newFakeBeRoot(t *testing.T) beRootInterface {
+	t.Helper()
+	r, _, err := NewFakeClient(context.Background())
+	if err != nil {
+		t.Fatalf("NewFakeClient: %v", err)
+	}
+	return r
+}
+
+func TestFakeClientCapabilities(t *testing.T) {
+	r := newFakeBeRoot(t)
+	br, ok := r.(*beRoot)
+	if !ok {
+		t.Fatalf("NewFakeClient returned %T, want *beRoot", r)
+	}
+	if len(br.Capabilities().Capabilities) == 0 {
+		t.Fatal("Capabilities() returned no capabilities")
+	}
+}
+
+func TestFakeClientUploadAndLargeFile(t *testing.T) {
+	r := newFakeBeRoot(t)
+
+	bucket, err := r.createBucket(context.Background(), "bucket", "allPrivate")
+	if err != nil {
+		t.Fatalf("createBucket: %v", err)
+	}
+
+	url, err := bucket.getUploadURL(context.Background())
+	if err != nil {
+		t.Fatalf("getUploadURL: %v", err)
+	}
+	data := []byte("hello from the b2 fake adapter")
+	if _, err := url.uploadFile(context.Background(), bytes.NewReader(data), len(data), "foo.txt", "text/plain", "", nil, nil); err != nil {
+		t.Fatalf("uploadFile: %v", err)
+	}
+
+	lf, err := bucket.startLargeFile(context.Background(), "big.bin", "application/octet-stream", nil, nil)
+	if err != nil {
+		t.Fatalf("startLargeFile: %v", err)
+	}
+	parts := [][]byte{bytes.Repeat([]byte("a"), MinLargeFilePartSize), bytes.Repeat([]byte("b"), 1024)}
+	var hashes []string
+	for i, part := range parts {
+		p, err := lf.getUploadPartURL(context.Background())
+		if err != nil {
+			t.Fatalf("getUploadPartURL: %v", err)
+		}
+		sum, err := sha1OfSection(bytes.NewReader(part), 0, int64(len(part)))
+		if err != nil {
+			t.Fatalf("sha1OfSection: %v", err)
+		}
+		if _, err := p.uploadPart(context.Background(), bytes.NewReader(part), sum, len(part), i+1); err != nil {
+			t.Fatalf("uploadPart: %v", err)
+		}
+		hashes = append(hashes, sum)
+	}
+	if _, err := lf.finishLargeFile(context.Background(), hashes); err != nil {
+		t.Fatalf("finishLargeFile: %v", err)
+	}
+}
+
+func TestBucketDefaultEncryptionRoundTrip(t *testing.T) {
+	r := newFakeBeRoot(t)
+	bucket, err := r.createBucket(context.Background(), "bucket", "allPrivate")
+	if err != nil {
+		t.Fatalf("createBucket: %v", err)
+	}
+	sse := &EncryptionSettings{Mode: SSEB2, Algorithm: "AES256"}
+	if err := bucket.setDefaultEncryption(context.Background(), sse); err != nil {
+		t.Fatalf("setDefaultEncryption: %v", err)
+	}
+	got, err := bucket.defaultEncryption(context.Background())
+	if err != nil {
+		t.Fatalf("defaultEncryption: %v", err)
+	}
+	if got == nil || !reflect.DeepEqual(got, sse) {
+		t.Fatalf("defaultEncryption: got %+v, want %+v", got, sse)
+	}
+
+	url, err := bucket.getUploadURL(context.Background())
+	if err != nil {
+		t.Fatalf("getUploadURL: %v", err)
+	}
+	data := []byte("hello from the b2 fake adapter")
+	file, err := url.uploadFile(context.Background(), bytes.NewReader(data), len(data), "foo.txt", "text/plain", "", nil, nil)
+	if err != nil {
+		t.Fatalf("uploadFile: %v", err)
+	}
+	if enc := file.info().Encryption; enc == nil || !reflect.DeepEqual(enc, sse) {
+		t.Fatalf("info().Encryption: got %+v, want the bucket default %+v", enc, sse)
+	}
+}
+
+func TestUploadLargeFileOrchestrator(t *testing.T) {
+	r := newFakeBeRoot(t)
+	bucket, err := r.createBucket(context.Background(), "bucket", "allPrivate")
+	if err != nil {
+		t.Fatalf("createBucket: %v", err)
+	}
+	size := int64(MinLargeFilePartSize) + 1024
+	data := bytes.Repeat([]byte("x"), int(size))
+	if _, err := uploadLargeFile(context.Background(), bucket, "big.bin", "application/octet-stream", nil, nil, bytes.NewReader(data), size, MinLargeFilePartSize, 4); err != nil {
+		t.Fatalf("uploadLargeFile: %v", err)
+	}
+}
+
+type countingPolicy struct {
+	max int
+}
+
+func (p *countingPolicy) Next(attempt int, lastErr error) (time.Duration, bool) {
+	if attempt > p.max {
+		return 0, false
+	}
+	return time.Millisecond, true
+}
+
+func (p *countingPolicy) NewChain() BackoffPolicy { return p }
+
+// TestWithBackoffEnforcesAttemptCap verifies withBackoff stops retrying once
+// the configured BackoffPolicy's attempt-count cap is reached.
+func TestWithBackoffEnforcesAttemptCap(t *testing.T) {
+	policy := &countingPolicy{max: 3}
+	ri := &fakeCappedRoot{policy: policy}
+
+	attempts := 0
+	f := func() (bool, error) {
+		attempts++
+		return false, &testTransientError{}
+	}
+	err := withBackoff(context.Background(), ri, f)
+	if err == nil {
+		t.Fatal("expected withBackoff to eventually give up and return an error")
+	}
+	if attempts > policy.max+1 {
+		t.Fatalf("withBackoff made %d attempts, want at most %d (policy cap)", attempts, policy.max+1)
+	}
+}
+
+type testTransientError struct{}
+
+func (e *testTransientError) Error() string { return "transient" }
+
+// fakeCappedRoot drives withBackoff through a countingPolicy to verify the
+// policy's own attempt cap is respected.
+type fakeCappedRoot struct {
+	beRootInterface
+	policy *countingPolicy
+}
+
+func (r *fakeCappedRoot) reauth(error) bool             { return false }
+func (r *fakeCappedRoot) transient(error) bool          { return true }
+func (r *fakeCappedRoot) backoffPolicy() BackoffPolicy  { return r.policy }
+
+func TestEncryptionSettingsStringRedactsCustomerKey(t *testing.T) {
+	sse := &EncryptionSettings{
+		Mode:           SSEC,
+		Algorithm:      "AES256",
+		CustomerKey:    []byte("super-secret-key-material"),
+		CustomerKeyMD5: "abc123",
+	}
+	s := sse.String()
+	if strings.Contains(s, "super-secret-key-material") {
+		t.Fatalf("String() leaked the customer key: %s", s)
+	}
+	if !strings.Contains(s, "<redacted>") {
+		t.Fatalf("String() did not redact the customer key: %s", s)
+	}
+}
@@ -0,0 +1,578 @@
+// Copyright 2016, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package b2fake implements an in-memory stand-in for the B2 API, so that
+// code built on top of the b2 package can be exercised hermetically, with
+// no network access and no real account credentials.
+package b2fake
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Error is the error type returned by every Root/Bucket/URL/File method. It
+// carries enough of a real B2 error response to drive the b2 package's
+// backoff, reauth and transient classification.
+type Error struct {
+	Status     int
+	Code       string
+	Msg        string
+	RetryAfter string // raw Retry-After header value, when Status == 503
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("b2fake: %d %s: %s", e.Status, e.Code, e.Msg)
+}
+
+// HTTPRetryAfter implements b2.RetryAfterError, so a configured BackoffPolicy
+// can honor the fake backend's injected Retry-After value directly.
+func (e *Error) HTTPRetryAfter() (string, bool) {
+	if e.Status != 503 || e.RetryAfter == "" {
+		return "", false
+	}
+	return e.RetryAfter, true
+}
+
+func unauthorized(code, msg string) error {
+	return &Error{Status: 401, Code: code, Msg: msg}
+}
+
+// EncryptionInfo mirrors the server-side encryption parameters B2 accepts
+// on uploads and bucket defaults.
+type EncryptionInfo struct {
+	Mode           string
+	Algorithm      string
+	CustomerKey    []byte
+	CustomerKeyMD5 string
+}
+
+// Key is a fake application key.
+type Key struct {
+	ID, Name      string
+	Capabilities  []string
+	BucketID      string
+	NamePrefix    string
+	ValidDuration time.Duration
+	// ApplicationKey is the secret a caller authenticates with. Real B2
+	// only returns this once, from b2_create_key; it is never included in
+	// b2_list_keys responses, and ListKeys below redacts it to match.
+	ApplicationKey string
+	root           *Root
+}
+
+// DeleteKey removes the key from the account.
+func (k *Key) DeleteKey(ctx context.Context) error {
+	k.root.mu.Lock()
+	defer k.root.mu.Unlock()
+	k.root.delay("b2_delete_key")
+	for i, o := range k.root.keys {
+		if o.ID == k.ID {
+			k.root.keys = append(k.root.keys[:i], k.root.keys[i+1:]...)
+			return nil
+		}
+	}
+	return &Error{Status: 400, Code: "bad_request", Msg: "key not found"}
+}
+
+// Root is an in-memory B2 account. The zero value is not usable; construct
+// one with New.
+type Root struct {
+	// Fault injection knobs, toggled directly by tests.
+	FailSomeUploads      bool
+	ExpireSomeAuthTokens bool
+	ForceCapExceeded     bool
+	RetryAfter           string                   // injected on every probabilistic 503
+	Latency              map[string]time.Duration // per-endpoint artificial latency
+
+	mu          sync.Mutex
+	account     string
+	authKey     string
+	authorized  bool
+	expired     bool
+	tokenPrimed bool // one authenticated call has happened since ExpireSomeAuthTokens took effect
+	buckets     map[string]*Bucket
+	keys        []*Key
+
+	nextID int64
+}
+
+// New returns an empty fake account.
+func New() *Root {
+	return &Root{buckets: make(map[string]*Bucket)}
+}
+
+func (r *Root) delay(endpoint string) {
+	if d, ok := r.Latency[endpoint]; ok {
+		time.Sleep(d)
+	}
+}
+
+// maybeFail randomly returns a 503 with the configured Retry-After, for
+// exercising backoff policies.
+func (r *Root) maybeFail(pct int) error {
+	if pct <= 0 {
+		return nil
+	}
+	r.mu.Lock()
+	retryAfter := r.RetryAfter
+	r.mu.Unlock()
+	if rand.Intn(100) < pct {
+		return &Error{Status: 503, Code: "server_error", Msg: "fake-injected failure", RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// id hands out a unique ID. It uses an atomic counter rather than r.mu so it
+// can be called from code paths that already hold r.mu, b.mu or lf.mu.
+func (r *Root) id() string {
+	return fmt.Sprintf("%d", atomic.AddInt64(&r.nextID, 1))
+}
+
+func (r *Root) AuthorizeAccount(ctx context.Context, account, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delay("b2_authorize_account")
+	if r.ForceCapExceeded {
+		return unauthorized("unauthorized", "capability exceeded")
+	}
+	r.account = account
+	r.authKey = key
+	r.authorized = true
+	r.expired = false
+	r.tokenPrimed = false
+	return nil
+}
+
+// Capabilities reports the capability set the fake account was authorized
+// with. The in-memory fake always grants full access.
+func (r *Root) Capabilities() ([]string, string, string) {
+	return []string{"listKeys", "writeKeys", "deleteKeys", "listBuckets", "writeFiles", "readFiles", "deleteFiles"}, "", ""
+}
+
+// checkAuthLocked implements the auth check below; callers must already
+// hold r.mu. When ExpireSomeAuthTokens is toggled on mid-test, the call that
+// happens to observe the toggle is typically harness setup (e.g. the
+// CreateBucket before a test's real assertions start), so expiry is primed
+// one call after the toggle is first seen and only takes effect starting
+// the call after that — not on the very next authenticated call.
+func (r *Root) checkAuthLocked() error {
+	if !r.authorized {
+		return unauthorized("unauthorized", "not authorized")
+	}
+	if r.expired {
+		return unauthorized("expired_auth_token", "auth token expired")
+	}
+	if r.ExpireSomeAuthTokens {
+		if r.tokenPrimed {
+			r.expired = true
+		} else {
+			r.tokenPrimed = true
+		}
+	}
+	return nil
+}
+
+// checkAuth is checkAuthLocked for callers that aren't already holding r.mu.
+func (r *Root) checkAuth() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.checkAuthLocked()
+}
+
+func (r *Root) CreateBucket(ctx context.Context, name, btype string) (*Bucket, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delay("b2_create_bucket")
+	if err := r.checkAuthLocked(); err != nil {
+		return nil, err
+	}
+	if err := r.maybeFail(0); err != nil {
+		return nil, err
+	}
+	b := &Bucket{
+		id:    r.id(),
+		name:  name,
+		btype: btype,
+		files: make(map[string][]*FileVersion),
+		root:  r,
+	}
+	r.buckets[name] = b
+	return b, nil
+}
+
+func (r *Root) ListBuckets(ctx context.Context) ([]*Bucket, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delay("b2_list_buckets")
+	if err := r.checkAuthLocked(); err != nil {
+		return nil, err
+	}
+	var out []*Bucket
+	for _, b := range r.buckets {
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+func (r *Root) CreateKey(ctx context.Context, name string, caps []string, valid time.Duration, bucketID, namePrefix string) (*Key, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delay("b2_create_key")
+	if err := r.checkAuthLocked(); err != nil {
+		return nil, err
+	}
+	id := r.id()
+	k := &Key{
+		ID:             id,
+		Name:           name,
+		Capabilities:   caps,
+		BucketID:       bucketID,
+		NamePrefix:     namePrefix,
+		ValidDuration:  valid,
+		ApplicationKey: "fake-application-key-" + id,
+		root:           r,
+	}
+	r.keys = append(r.keys, k)
+	return k, nil
+}
+
+func (r *Root) ListKeys(ctx context.Context) ([]*Key, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delay("b2_list_keys")
+	if err := r.checkAuthLocked(); err != nil {
+		return nil, err
+	}
+	out := make([]*Key, len(r.keys))
+	for i, k := range r.keys {
+		redacted := *k
+		redacted.ApplicationKey = ""
+		out[i] = &redacted
+	}
+	return out, nil
+}
+
+// Bucket is an in-memory B2 bucket.
+type Bucket struct {
+	mu         sync.Mutex
+	id, name   string
+	btype      string
+	files      map[string][]*FileVersion
+	largeFiles map[string]*LargeFile
+	encryption *EncryptionInfo
+	root       *Root
+}
+
+func (b *Bucket) Name() string { return b.name }
+
+func (b *Bucket) Delete(ctx context.Context) error {
+	b.root.mu.Lock()
+	defer b.root.mu.Unlock()
+	if err := b.root.checkAuthLocked(); err != nil {
+		return err
+	}
+	delete(b.root.buckets, b.name)
+	return nil
+}
+
+func (b *Bucket) SetDefaultEncryption(ctx context.Context, sse *EncryptionInfo) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.root.delay("b2_update_bucket")
+	if err := b.root.checkAuth(); err != nil {
+		return err
+	}
+	b.encryption = sse
+	return nil
+}
+
+// DefaultEncryption returns the bucket's current default server-side
+// encryption, as set by SetDefaultEncryption, mirroring what a real
+// b2_list_buckets/b2_update_bucket response would report.
+func (b *Bucket) DefaultEncryption(ctx context.Context) (*EncryptionInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.root.delay("b2_update_bucket")
+	if err := b.root.checkAuth(); err != nil {
+		return nil, err
+	}
+	return b.encryption, nil
+}
+
+func (b *Bucket) GetUploadURL(ctx context.Context) (*URL, error) {
+	b.root.delay("b2_get_upload_url")
+	if err := b.root.checkAuth(); err != nil {
+		return nil, err
+	}
+	return &URL{bucket: b}, nil
+}
+
+func (b *Bucket) StartLargeFile(ctx context.Context, name, ct string, info map[string]string, sse *EncryptionInfo) (*LargeFile, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.root.delay("b2_start_large_file")
+	if err := b.root.checkAuth(); err != nil {
+		return nil, err
+	}
+	if sse == nil {
+		sse = b.encryption
+	}
+	lf := &LargeFile{
+		id:     b.root.id(),
+		name:   name,
+		ct:     ct,
+		info:   info,
+		sse:    sse,
+		bucket: b,
+		parts:  make(map[int]*FileVersion),
+	}
+	if b.largeFiles == nil {
+		b.largeFiles = make(map[string]*LargeFile)
+	}
+	b.largeFiles[lf.id] = lf
+	return lf, nil
+}
+
+func (b *Bucket) ListUnfinishedLargeFiles(ctx context.Context) ([]*LargeFile, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.root.delay("b2_list_unfinished_large_files")
+	if err := b.root.checkAuth(); err != nil {
+		return nil, err
+	}
+	var out []*LargeFile
+	for _, lf := range b.largeFiles {
+		if !lf.finished && !lf.canceled {
+			out = append(out, lf)
+		}
+	}
+	return out, nil
+}
+
+// URL is a fake upload URL, valid for a single bucket.
+type URL struct {
+	bucket *Bucket
+}
+
+func (u *URL) UploadFile(ctx context.Context, r io.Reader, size int, name, ct, sha1sum string, info map[string]string, sse *EncryptionInfo) (*FileVersion, error) {
+	b := u.bucket
+	b.root.delay("b2_upload_file")
+	if err := b.root.checkAuth(); err != nil {
+		return nil, err
+	}
+	if err := b.root.maybeFail(failUploadPct(b.root)); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if got := sha1Hex(data); sha1sum != "" && got != sha1sum {
+		return nil, &Error{Status: 400, Code: "bad_request", Msg: "sha1 mismatch"}
+	}
+	if sse == nil {
+		b.mu.Lock()
+		sse = b.encryption
+		b.mu.Unlock()
+	}
+	fv := &FileVersion{
+		id:   b.root.id(),
+		name: name,
+		data: data,
+		sha1: sha1Hex(data),
+		info: info,
+		sse:  sse,
+		b:    b,
+	}
+	b.mu.Lock()
+	b.files[name] = append(b.files[name], fv)
+	b.mu.Unlock()
+	return fv, nil
+}
+
+func failUploadPct(r *Root) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.FailSomeUploads {
+		return 25
+	}
+	return 0
+}
+
+// FileVersion is one uploaded version of a named file.
+type FileVersion struct {
+	id, name string
+	data     []byte
+	sha1     string
+	info     map[string]string
+	sse      *EncryptionInfo
+	b        *Bucket
+}
+
+// Encryption returns the server-side encryption settings actually applied
+// to this file version, whether it came from an explicit per-upload
+// setting or the bucket's default.
+func (f *FileVersion) Encryption() *EncryptionInfo { return f.sse }
+
+func (f *FileVersion) DeleteFileVersion(ctx context.Context) error {
+	f.b.root.delay("b2_delete_file_version")
+	if err := f.b.root.checkAuth(); err != nil {
+		return err
+	}
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	versions := f.b.files[f.name]
+	for i, v := range versions {
+		if v == f {
+			f.b.files[f.name] = append(versions[:i], versions[i+1:]...)
+			return nil
+		}
+	}
+	return &Error{Status: 400, Code: "bad_request", Msg: "file not found"}
+}
+
+// LargeFile is an in-progress (or finished) multi-part upload.
+type LargeFile struct {
+	mu       sync.Mutex
+	id, name string
+	ct       string
+	info     map[string]string
+	sse      *EncryptionInfo
+	bucket   *Bucket
+	parts    map[int]*FileVersion
+	nextPart int
+	finished bool
+	canceled bool
+}
+
+// ID returns the large file ID assigned by StartLargeFile, for matching
+// against ListUnfinishedLargeFiles when resuming an upload.
+func (l *LargeFile) ID() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.id
+}
+
+func (l *LargeFile) GetUploadPartURL(ctx context.Context) (*FilePart, error) {
+	l.bucket.root.delay("b2_get_upload_part_url")
+	if err := l.bucket.root.checkAuth(); err != nil {
+		return nil, err
+	}
+	return &FilePart{lf: l}, nil
+}
+
+func (l *LargeFile) FinishLargeFile(ctx context.Context, hashes []string) (*FileVersion, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bucket.root.delay("b2_finish_large_file")
+	if err := l.bucket.root.checkAuth(); err != nil {
+		return nil, err
+	}
+	var data []byte
+	for i := 1; i <= len(hashes); i++ {
+		p, ok := l.parts[i]
+		if !ok {
+			return nil, &Error{Status: 400, Code: "bad_request", Msg: "missing part"}
+		}
+		data = append(data, p.data...)
+	}
+	fv := &FileVersion{
+		id:   l.bucket.root.id(),
+		name: l.name,
+		data: data,
+		sha1: sha1Hex(data),
+		info: l.info,
+		sse:  l.sse,
+		b:    l.bucket,
+	}
+	l.bucket.mu.Lock()
+	l.bucket.files[l.name] = append(l.bucket.files[l.name], fv)
+	l.bucket.mu.Unlock()
+	l.finished = true
+	return fv, nil
+}
+
+func (l *LargeFile) CancelLargeFile(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bucket.root.delay("b2_cancel_large_file")
+	if err := l.bucket.root.checkAuth(); err != nil {
+		return err
+	}
+	l.canceled = true
+	return nil
+}
+
+// PartInfo describes one already-uploaded part, for resuming an upload.
+type PartInfo struct {
+	Number int
+	SHA1   string
+	Size   int
+}
+
+func (l *LargeFile) ListParts(ctx context.Context) ([]*PartInfo, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bucket.root.delay("b2_list_parts")
+	if err := l.bucket.root.checkAuth(); err != nil {
+		return nil, err
+	}
+	var out []*PartInfo
+	for n, p := range l.parts {
+		out = append(out, &PartInfo{Number: n, SHA1: p.sha1, Size: len(p.data)})
+	}
+	return out, nil
+}
+
+// FilePart is a single-use upload URL for one part of a large file.
+type FilePart struct {
+	lf *LargeFile
+}
+
+func (p *FilePart) UploadPart(ctx context.Context, r io.Reader, sha1sum string, size, index int) (int, error) {
+	lf := p.lf
+	lf.bucket.root.delay("b2_upload_part")
+	if err := lf.bucket.root.checkAuth(); err != nil {
+		return 0, err
+	}
+	if err := lf.bucket.root.maybeFail(failUploadPct(lf.bucket.root)); err != nil {
+		return 0, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	if got := sha1Hex(data); sha1sum != "" && got != sha1sum {
+		return 0, &Error{Status: 400, Code: "bad_request", Msg: "sha1 mismatch"}
+	}
+	lf.mu.Lock()
+	lf.parts[index] = &FileVersion{data: data, sha1: sha1Hex(data)}
+	lf.mu.Unlock()
+	return len(data), nil
+}
+
+func sha1Hex(b []byte) string {
+	h := sha1.Sum(b)
+	return hex.EncodeToString(h[:])
+}
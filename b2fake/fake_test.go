@@ -0,0 +1,256 @@
+// Copyright 2016, Google
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2fake
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func newAuthorized(t *testing.T) *Root {
+	t.Helper()
+	r := New()
+	if err := r.AuthorizeAccount(context.Background(), "account", "key"); err != nil {
+		t.Fatalf("AuthorizeAccount: %v", err)
+	}
+	return r
+}
+
+func TestUploadAndDeleteFile(t *testing.T) {
+	r := newAuthorized(t)
+	b, err := r.CreateBucket(context.Background(), "bucket", "allPrivate")
+	if err != nil {
+		t.Fatalf("CreateBucket: %v", err)
+	}
+	url, err := b.GetUploadURL(context.Background())
+	if err != nil {
+		t.Fatalf("GetUploadURL: %v", err)
+	}
+	data := []byte("hello, world")
+	fv, err := url.UploadFile(context.Background(), bytes.NewReader(data), len(data), "foo.txt", "text/plain", "", nil, nil)
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if err := fv.DeleteFileVersion(context.Background()); err != nil {
+		t.Fatalf("DeleteFileVersion: %v", err)
+	}
+}
+
+func TestListKeysRedactsApplicationKey(t *testing.T) {
+	r := newAuthorized(t)
+	k, err := r.CreateKey(context.Background(), "key", []string{"listKeys"}, 0, "", "")
+	if err != nil {
+		t.Fatalf("CreateKey: %v", err)
+	}
+	if k.ApplicationKey == "" {
+		t.Fatalf("CreateKey: got empty ApplicationKey, want the one-time secret")
+	}
+	ks, err := r.ListKeys(context.Background())
+	if err != nil {
+		t.Fatalf("ListKeys: %v", err)
+	}
+	if len(ks) != 1 || ks[0].ApplicationKey != "" {
+		t.Fatalf("ListKeys: got keys %+v, want one key with a redacted ApplicationKey", ks)
+	}
+	if err := ks[0].DeleteKey(context.Background()); err != nil {
+		t.Fatalf("DeleteKey on a listed key: %v", err)
+	}
+	if ks, err := r.ListKeys(context.Background()); err != nil || len(ks) != 0 {
+		t.Fatalf("ListKeys after delete: got %+v, %v, want no keys", ks, err)
+	}
+}
+
+func TestSetDefaultEncryptionAppliedToUpload(t *testing.T) {
+	r := newAuthorized(t)
+	b, err := r.CreateBucket(context.Background(), "bucket", "allPrivate")
+	if err != nil {
+		t.Fatalf("CreateBucket: %v", err)
+	}
+	sse := &EncryptionInfo{Mode: "SSE-B2", Algorithm: "AES256"}
+	if err := b.SetDefaultEncryption(context.Background(), sse); err != nil {
+		t.Fatalf("SetDefaultEncryption: %v", err)
+	}
+	url, err := b.GetUploadURL(context.Background())
+	if err != nil {
+		t.Fatalf("GetUploadURL: %v", err)
+	}
+	data := []byte("hello, world")
+	fv, err := url.UploadFile(context.Background(), bytes.NewReader(data), len(data), "foo.txt", "text/plain", "", nil, nil)
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if fv.sse != sse {
+		t.Fatalf("UploadFile: got sse %+v, want the bucket default %+v", fv.sse, sse)
+	}
+
+	explicit := &EncryptionInfo{Mode: "SSE-C", Algorithm: "AES256"}
+	fv2, err := url.UploadFile(context.Background(), bytes.NewReader(data), len(data), "bar.txt", "text/plain", "", nil, explicit)
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if fv2.sse != explicit {
+		t.Fatalf("UploadFile: got sse %+v, want the explicit override %+v", fv2.sse, explicit)
+	}
+}
+
+func TestSetDefaultEncryptionAppliedToLargeFile(t *testing.T) {
+	r := newAuthorized(t)
+	b, err := r.CreateBucket(context.Background(), "bucket", "allPrivate")
+	if err != nil {
+		t.Fatalf("CreateBucket: %v", err)
+	}
+	sse := &EncryptionInfo{Mode: "SSE-B2", Algorithm: "AES256"}
+	if err := b.SetDefaultEncryption(context.Background(), sse); err != nil {
+		t.Fatalf("SetDefaultEncryption: %v", err)
+	}
+	lf, err := b.StartLargeFile(context.Background(), "big.bin", "application/octet-stream", nil, nil)
+	if err != nil {
+		t.Fatalf("StartLargeFile: %v", err)
+	}
+	part := []byte("part one")
+	p, err := lf.GetUploadPartURL(context.Background())
+	if err != nil {
+		t.Fatalf("GetUploadPartURL: %v", err)
+	}
+	sum := sha1Hex(part)
+	if _, err := p.UploadPart(context.Background(), bytes.NewReader(part), sum, len(part), 1); err != nil {
+		t.Fatalf("UploadPart: %v", err)
+	}
+	fv, err := lf.FinishLargeFile(context.Background(), []string{sum})
+	if err != nil {
+		t.Fatalf("FinishLargeFile: %v", err)
+	}
+	if fv.sse != sse {
+		t.Fatalf("FinishLargeFile: got sse %+v, want the bucket default %+v", fv.sse, sse)
+	}
+}
+
+func TestLargeFileRoundTrip(t *testing.T) {
+	r := newAuthorized(t)
+	b, err := r.CreateBucket(context.Background(), "bucket", "allPrivate")
+	if err != nil {
+		t.Fatalf("CreateBucket: %v", err)
+	}
+	lf, err := b.StartLargeFile(context.Background(), "big.bin", "application/octet-stream", nil, nil)
+	if err != nil {
+		t.Fatalf("StartLargeFile: %v", err)
+	}
+	if lf.ID() == "" {
+		t.Fatal("ID() returned empty string")
+	}
+	var hashes []string
+	for i, part := range [][]byte{[]byte("part one"), []byte("part two")} {
+		p, err := lf.GetUploadPartURL(context.Background())
+		if err != nil {
+			t.Fatalf("GetUploadPartURL: %v", err)
+		}
+		sum := sha1Hex(part)
+		if _, err := p.UploadPart(context.Background(), bytes.NewReader(part), sum, len(part), i+1); err != nil {
+			t.Fatalf("UploadPart: %v", err)
+		}
+		hashes = append(hashes, sum)
+	}
+	if _, err := lf.FinishLargeFile(context.Background(), hashes); err != nil {
+		t.Fatalf("FinishLargeFile: %v", err)
+	}
+
+	unfinished, err := b.ListUnfinishedLargeFiles(context.Background())
+	if err != nil {
+		t.Fatalf("ListUnfinishedLargeFiles: %v", err)
+	}
+	for _, u := range unfinished {
+		if u.ID() == lf.ID() {
+			t.Fatalf("finished large file %q still listed as unfinished", lf.ID())
+		}
+	}
+}
+
+func TestCheckAuthExpiry(t *testing.T) {
+	r := newAuthorized(t)
+	r.ExpireSomeAuthTokens = true
+	b, err := r.CreateBucket(context.Background(), "bucket", "allPrivate")
+	if err != nil {
+		t.Fatalf("CreateBucket: %v", err)
+	}
+	if _, err := b.GetUploadURL(context.Background()); err != nil {
+		t.Fatalf("first GetUploadURL: %v", err)
+	}
+	if _, err := b.GetUploadURL(context.Background()); err == nil {
+		t.Fatal("expected expired_auth_token error on second call, got nil")
+	}
+}
+
+// TestLatencyAppliedToUploadPath verifies that the per-endpoint Latency
+// knob is honored on the upload/large-file paths, not just the
+// account-level endpoints it was originally wired into.
+func TestLatencyAppliedToUploadPath(t *testing.T) {
+	r := newAuthorized(t)
+	delay := 20 * time.Millisecond
+	r.Latency = map[string]time.Duration{"b2_upload_file": delay}
+	b, err := r.CreateBucket(context.Background(), "bucket", "allPrivate")
+	if err != nil {
+		t.Fatalf("CreateBucket: %v", err)
+	}
+	url, err := b.GetUploadURL(context.Background())
+	if err != nil {
+		t.Fatalf("GetUploadURL: %v", err)
+	}
+	data := []byte("hello, world")
+	start := time.Now()
+	if _, err := url.UploadFile(context.Background(), bytes.NewReader(data), len(data), "foo.txt", "text/plain", "", nil, nil); err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Fatalf("UploadFile returned after %v, want at least the configured %v latency", elapsed, delay)
+	}
+}
+
+// TestConcurrentPartUploadsUnderRace exercises the access pattern of a
+// concurrent part-upload pool: many goroutines calling GetUploadPartURL
+// against the same large file (and so the same Root) at once, with auth
+// tokens expiring. Run with -race; it regression-tests the checkAuth locking
+// fix.
+func TestConcurrentPartUploadsUnderRace(t *testing.T) {
+	r := newAuthorized(t)
+	r.ExpireSomeAuthTokens = true
+	b, err := r.CreateBucket(context.Background(), "bucket", "allPrivate")
+	if err != nil {
+		t.Fatalf("CreateBucket: %v", err)
+	}
+	lf, err := b.StartLargeFile(context.Background(), "big.bin", "application/octet-stream", nil, nil)
+	if err != nil {
+		t.Fatalf("StartLargeFile: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := lf.GetUploadPartURL(context.Background()); err != nil {
+					// Expired tokens are expected here; the test only cares
+					// that concurrent access is race-free, not error-free.
+					continue
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}